@@ -0,0 +1,393 @@
+package history
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/guregu/null"
+	"github.com/stellar/go/support/db"
+	"github.com/stellar/go/support/errors"
+	"github.com/stellar/go/xdr"
+)
+
+// TrustLineChangeType describes the kind of mutation that produced a
+// trust_line_changes row.
+type TrustLineChangeType string
+
+const (
+	TrustLineChangeTypeCreate TrustLineChangeType = "create"
+	TrustLineChangeTypeUpdate TrustLineChangeType = "update"
+	TrustLineChangeTypeRemove TrustLineChangeType = "remove"
+)
+
+// TrustLineChange is a row of the trust_line_changes table, recording the
+// before/after state of a single trust line mutation applied during
+// ingestion.
+type TrustLineChange struct {
+	ID                         int64               `db:"id"`
+	LedgerSequence             uint32              `db:"ledger_sequence"`
+	LedgerClosedAt             time.Time           `db:"ledger_closed_at"`
+	LedgerKey                  string              `db:"ledger_key"`
+	ChangeType                 TrustLineChangeType `db:"change_type"`
+	PreviousBalance            null.Int            `db:"previous_balance"`
+	NewBalance                 null.Int            `db:"new_balance"`
+	PreviousTrustLineLimit     null.Int            `db:"previous_trust_line_limit"`
+	NewTrustLineLimit          null.Int            `db:"new_trust_line_limit"`
+	PreviousFlags              null.Int            `db:"previous_flags"`
+	NewFlags                   null.Int            `db:"new_flags"`
+	PreviousBuyingLiabilities  null.Int            `db:"previous_buying_liabilities"`
+	NewBuyingLiabilities       null.Int            `db:"new_buying_liabilities"`
+	PreviousSellingLiabilities null.Int            `db:"previous_selling_liabilities"`
+	NewSellingLiabilities      null.Int            `db:"new_selling_liabilities"`
+}
+
+// TrustLineChangesPagination mirrors the cursor/limit pagination shape used
+// by the Soroban RPC getTransactions endpoint.
+type TrustLineChangesPagination struct {
+	Cursor string
+	Limit  int
+}
+
+// TrustLineChangesRequest is the input to GetTrustLineChanges.
+type TrustLineChangesRequest struct {
+	StartLedger uint32
+	Pagination  *TrustLineChangesPagination
+}
+
+// TrustLineChangesResponse is the output of GetTrustLineChanges.
+type TrustLineChangesResponse struct {
+	Changes                    []TrustLineChange
+	LatestLedger               uint32
+	LatestLedgerCloseTimestamp int64
+	OldestLedger               uint32
+	OldestLedgerCloseTimestamp int64
+	Cursor                     string
+}
+
+const defaultTrustLineChangesLimit = 100
+
+// encodeTrustLineChangesCursor packs the (ledger_sequence, id) of the last
+// row returned into the opaque cursor callers pass back to fetch the next
+// page. id is the tiebreaker within a ledger_sequence and is strictly
+// increasing, so the pair is a stable keyset position.
+func encodeTrustLineChangesCursor(ledgerSequence uint32, id int64) string {
+	raw := fmt.Sprintf("%d-%d", ledgerSequence, id)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// decodeTrustLineChangesCursor is the inverse of encodeTrustLineChangesCursor.
+func decodeTrustLineChangesCursor(cursor string) (ledgerSequence uint32, id int64, err error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "invalid cursor encoding")
+	}
+	parts := strings.SplitN(string(raw), "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, errors.New("invalid cursor format")
+	}
+	seq, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "invalid cursor ledger sequence")
+	}
+	rowID, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "invalid cursor id")
+	}
+	return uint32(seq), rowID, nil
+}
+
+// trustLineSnapshot is the subset of trust_lines columns needed to diff the
+// previous state of a row against the one an upsert is about to write.
+type trustLineSnapshot struct {
+	LedgerKey          string     `db:"ledger_key"`
+	Balance            xdr.Int64  `db:"balance"`
+	TrustLineLimit     xdr.Int64  `db:"trust_line_limit"`
+	Flags              xdr.Uint32 `db:"flags"`
+	BuyingLiabilities  xdr.Int64  `db:"buying_liabilities"`
+	SellingLiabilities xdr.Int64  `db:"selling_liabilities"`
+}
+
+// trustLineSnapshotsByKey loads the current trust_lines rows for the given
+// ledger keys, keyed by ledger_key, so callers can diff against them before
+// overwriting. It takes a *db.Session directly (rather than a *Q) so both Q
+// methods and TrustLinesBatchInserter, which only holds a session, can share
+// it.
+func trustLineSnapshotsByKey(ctx context.Context, session *db.Session, ledgerKeys []string) (map[string]trustLineSnapshot, error) {
+	result := map[string]trustLineSnapshot{}
+	if len(ledgerKeys) == 0 {
+		return result, nil
+	}
+
+	var rows []trustLineSnapshot
+	sql := sq.Select("ledger_key, balance, trust_line_limit, flags, buying_liabilities, selling_liabilities").
+		From("trust_lines").
+		Where(sq.Eq{"ledger_key": ledgerKeys})
+	if err := session.Select(ctx, &rows, sql); err != nil {
+		return nil, errors.Wrap(err, "could not select trust line snapshots")
+	}
+	for _, row := range rows {
+		result[row.LedgerKey] = row
+	}
+	return result, nil
+}
+
+// trustLineSnapshotsByKey is the Q-bound convenience wrapper used by callers
+// that already have a *Q (e.g. RemoveTrustLine, batchRemoveTrustLines).
+func (q *Q) trustLineSnapshotsByKey(ctx context.Context, ledgerKeys []string) (map[string]trustLineSnapshot, error) {
+	return trustLineSnapshotsByKey(ctx, q.Session, ledgerKeys)
+}
+
+// insertTrustLineChange records a single trust line mutation. It is called
+// from RemoveTrustLine; UpsertTrustLines records its changes through
+// bulkInsertTrustLineChanges instead.
+func (q *Q) insertTrustLineChange(ctx context.Context, change TrustLineChange) error {
+	sql := sq.Insert("trust_line_changes").SetMap(map[string]interface{}{
+		"ledger_sequence":              change.LedgerSequence,
+		"ledger_closed_at":             change.LedgerClosedAt,
+		"ledger_key":                   change.LedgerKey,
+		"change_type":                  change.ChangeType,
+		"previous_balance":             change.PreviousBalance,
+		"new_balance":                  change.NewBalance,
+		"previous_trust_line_limit":    change.PreviousTrustLineLimit,
+		"new_trust_line_limit":         change.NewTrustLineLimit,
+		"previous_flags":               change.PreviousFlags,
+		"new_flags":                    change.NewFlags,
+		"previous_buying_liabilities":  change.PreviousBuyingLiabilities,
+		"new_buying_liabilities":       change.NewBuyingLiabilities,
+		"previous_selling_liabilities": change.PreviousSellingLiabilities,
+		"new_selling_liabilities":      change.NewSellingLiabilities,
+	})
+	_, err := q.Exec(ctx, sql)
+	return err
+}
+
+// bulkInsertTrustLineChanges inserts every change in a single multi-row
+// INSERT, rather than one round trip per row. Like trustLineSnapshotsByKey,
+// it takes a *db.Session directly so TrustLinesBatchInserter can call it
+// without needing a *Q.
+func bulkInsertTrustLineChanges(ctx context.Context, session *db.Session, changes []TrustLineChange) error {
+	if len(changes) == 0 {
+		return nil
+	}
+
+	insert := sq.Insert("trust_line_changes").Columns(
+		"ledger_sequence",
+		"ledger_closed_at",
+		"ledger_key",
+		"change_type",
+		"previous_balance",
+		"new_balance",
+		"previous_trust_line_limit",
+		"new_trust_line_limit",
+		"previous_flags",
+		"new_flags",
+		"previous_buying_liabilities",
+		"new_buying_liabilities",
+		"previous_selling_liabilities",
+		"new_selling_liabilities",
+	)
+	for _, change := range changes {
+		insert = insert.Values(
+			change.LedgerSequence,
+			change.LedgerClosedAt,
+			change.LedgerKey,
+			change.ChangeType,
+			change.PreviousBalance,
+			change.NewBalance,
+			change.PreviousTrustLineLimit,
+			change.NewTrustLineLimit,
+			change.PreviousFlags,
+			change.NewFlags,
+			change.PreviousBuyingLiabilities,
+			change.NewBuyingLiabilities,
+			change.PreviousSellingLiabilities,
+			change.NewSellingLiabilities,
+		)
+	}
+
+	_, err := session.Exec(ctx, insert)
+	return errors.Wrap(err, "could not bulk insert trust line changes")
+}
+
+// bulkInsertTrustLineChanges is the Q-bound convenience wrapper used by
+// callers that already have a *Q (e.g. batchRemoveTrustLines).
+func (q *Q) bulkInsertTrustLineChanges(ctx context.Context, changes []TrustLineChange) error {
+	return bulkInsertTrustLineChanges(ctx, q.Session, changes)
+}
+
+// batchRemoveTrustLines deletes every row matching keys in a single
+// statement and records the removals with one bulk trust_line_changes
+// insert, instead of issuing a snapshot/delete/insert round trip per key.
+func (q *Q) batchRemoveTrustLines(ctx context.Context, ledgerSequence uint32, ledgerCloseTime time.Time, keys []xdr.LedgerKeyTrustLine) (int64, error) {
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	if q.GetTx() == nil {
+		return 0, errors.New("cannot be called outside of a transaction")
+	}
+
+	lkeys := make([]string, 0, len(keys))
+	for _, key := range keys {
+		lkey, err := ledgerKeyTrustLineToString(key)
+		if err != nil {
+			return 0, errors.Wrap(err, "Error ledgerKeyTrustLineToString MarshalBinaryCompress")
+		}
+		lkeys = append(lkeys, lkey)
+	}
+
+	previous, err := q.trustLineSnapshotsByKey(ctx, lkeys)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := q.Exec(ctx, sq.Delete("trust_lines").Where(sq.Eq{"ledger_key": lkeys}))
+	if err != nil {
+		return 0, err
+	}
+
+	changes := make([]TrustLineChange, 0, len(lkeys))
+	for _, lkey := range lkeys {
+		change := TrustLineChange{
+			LedgerSequence: ledgerSequence,
+			LedgerClosedAt: ledgerCloseTime,
+			LedgerKey:      lkey,
+			ChangeType:     TrustLineChangeTypeRemove,
+		}
+		if prev, ok := previous[lkey]; ok {
+			change.PreviousBalance = null.IntFrom(int64(prev.Balance))
+			change.PreviousTrustLineLimit = null.IntFrom(int64(prev.TrustLineLimit))
+			change.PreviousFlags = null.IntFrom(int64(prev.Flags))
+			change.PreviousBuyingLiabilities = null.IntFrom(int64(prev.BuyingLiabilities))
+			change.PreviousSellingLiabilities = null.IntFrom(int64(prev.SellingLiabilities))
+		}
+		changes = append(changes, change)
+	}
+	if err := q.bulkInsertTrustLineChanges(ctx, changes); err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// trustLineChangeBounds holds the oldest/latest ledger bounds of the
+// trust_line_changes table. Its fields are nullable because min/max over an
+// empty table still return one row, just with every aggregate NULL rather
+// than no rows at all, so scanning into plain uint32/int64 would error.
+type trustLineChangeBounds struct {
+	OldestLedger               null.Int `db:"oldest_ledger"`
+	OldestLedgerCloseTimestamp null.Int `db:"oldest_ledger_close_timestamp"`
+	LatestLedger               null.Int `db:"latest_ledger"`
+	LatestLedgerCloseTimestamp null.Int `db:"latest_ledger_close_timestamp"`
+}
+
+// GetTrustLineChanges returns trust line changes recorded at or after
+// req.StartLedger, paginated similarly to the Soroban RPC getTransactions
+// endpoint: callers page forward by resubmitting the returned Cursor.
+func (q *Q) GetTrustLineChanges(ctx context.Context, req TrustLineChangesRequest) (TrustLineChangesResponse, error) {
+	var resp TrustLineChangesResponse
+
+	limit := defaultTrustLineChangesLimit
+	startLedger := req.StartLedger
+	var afterID int64 = -1
+	haveCursor := false
+	if req.Pagination != nil {
+		if req.Pagination.Limit > 0 {
+			limit = req.Pagination.Limit
+		}
+		if req.Pagination.Cursor != "" {
+			seq, id, err := decodeTrustLineChangesCursor(req.Pagination.Cursor)
+			if err != nil {
+				return resp, err
+			}
+			startLedger = seq
+			afterID = id
+			haveCursor = true
+		}
+	}
+
+	var bounds trustLineChangeBounds
+	boundsSQL := sq.Select(
+		"min(ledger_sequence) as oldest_ledger",
+		"extract(epoch from min(ledger_closed_at))::bigint as oldest_ledger_close_timestamp",
+		"max(ledger_sequence) as latest_ledger",
+		"extract(epoch from max(ledger_closed_at))::bigint as latest_ledger_close_timestamp",
+	).From("trust_line_changes")
+	if err := q.Get(ctx, &bounds, boundsSQL); err != nil {
+		return resp, errors.Wrap(err, "could not query trust line change bounds")
+	}
+	if !bounds.OldestLedger.Valid {
+		// Empty table (or, since there is no range filter yet, simply no
+		// changes recorded at all): the Soroban-RPC-style contract is an
+		// empty response, not an error.
+		return resp, nil
+	}
+	resp.OldestLedger = uint32(bounds.OldestLedger.Int64)
+	resp.OldestLedgerCloseTimestamp = bounds.OldestLedgerCloseTimestamp.Int64
+	resp.LatestLedger = uint32(bounds.LatestLedger.Int64)
+	resp.LatestLedgerCloseTimestamp = bounds.LatestLedgerCloseTimestamp.Int64
+
+	sql := sq.Select("*").From("trust_line_changes").
+		OrderBy("ledger_sequence asc", "id asc").
+		Limit(uint64(limit) + 1)
+	if haveCursor {
+		// Keyset pagination: strictly after the (ledger_sequence, id) pair
+		// encoded in the cursor. Using OFFSET here would overshoot once a
+		// later page's starting ledger_sequence has fewer rows than an
+		// earlier page, silently dropping rows.
+		sql = sql.Where(sq.Or{
+			sq.Gt{"ledger_sequence": startLedger},
+			sq.And{sq.Eq{"ledger_sequence": startLedger}, sq.Gt{"id": afterID}},
+		})
+	} else {
+		sql = sql.Where(sq.GtOrEq{"ledger_sequence": startLedger})
+	}
+
+	var changes []TrustLineChange
+	if err := q.Select(ctx, &changes, sql); err != nil {
+		return resp, errors.Wrap(err, "could not select trust line changes")
+	}
+
+	if len(changes) > limit {
+		changes = changes[:limit]
+	}
+	if len(changes) > 0 {
+		last := changes[len(changes)-1]
+		resp.Cursor = encodeTrustLineChangesCursor(last.LedgerSequence, last.ID)
+	}
+	resp.Changes = changes
+
+	return resp, nil
+}
+
+// ReapTrustLineChanges deletes trust_line_changes rows older than
+// retentionLedgerCount ledgers behind latestLedger, mirroring the retention
+// window approach used for other history tables.
+//
+// BACKLOG GAP: this is only the deletion primitive. The original request
+// asked for a --trust-line-retention-window flag plumbed through Q and a
+// background reaper loop that calls this periodically; neither exists in
+// this package or anywhere else in the ingestion system yet. Nothing
+// currently calls ReapTrustLineChanges in production, so trust_line_changes
+// grows unbounded until that flag and loop are added. Do not read this
+// comment as "done" — wiring the config and the loop is still open work.
+func (q *Q) ReapTrustLineChanges(ctx context.Context, latestLedger uint32, retentionLedgerCount uint32) (int64, error) {
+	if retentionLedgerCount == 0 {
+		return 0, nil
+	}
+	if latestLedger <= retentionLedgerCount {
+		return 0, nil
+	}
+	cutoff := latestLedger - retentionLedgerCount
+
+	sql := sq.Delete("trust_line_changes").Where(sq.Lt{"ledger_sequence": cutoff})
+	result, err := q.Exec(ctx, sql)
+	if err != nil {
+		return 0, errors.Wrap(err, "could not delete old trust line changes")
+	}
+	return result.RowsAffected()
+}
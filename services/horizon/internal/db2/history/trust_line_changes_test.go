@@ -0,0 +1,51 @@
+package history
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stellar/go/support/db/dbtest"
+)
+
+func TestTrustLineChangesCursorRoundTrip(t *testing.T) {
+	cursor := encodeTrustLineChangesCursor(12345, 67890)
+	seq, id, err := decodeTrustLineChangesCursor(cursor)
+	if err != nil {
+		t.Fatalf("decodeTrustLineChangesCursor returned error: %v", err)
+	}
+	if seq != 12345 {
+		t.Errorf("expected ledger sequence 12345, got %d", seq)
+	}
+	if id != 67890 {
+		t.Errorf("expected id 67890, got %d", id)
+	}
+}
+
+func TestTrustLineChangesCursorDecodeInvalid(t *testing.T) {
+	if _, _, err := decodeTrustLineChangesCursor("not-a-valid-cursor"); err == nil {
+		t.Error("expected an error decoding a malformed cursor, got nil")
+	}
+}
+
+func TestGetTrustLineChangesEmptyTable(t *testing.T) {
+	db := dbtest.Postgres(t)
+	defer db.Close()
+
+	session := db.Open()
+	defer session.Close()
+	q := &Q{session}
+
+	resp, err := q.GetTrustLineChanges(context.Background(), TrustLineChangesRequest{})
+	if err != nil {
+		t.Fatalf("GetTrustLineChanges on an empty table returned error: %v", err)
+	}
+	if len(resp.Changes) != 0 {
+		t.Errorf("expected no changes, got %d", len(resp.Changes))
+	}
+	if resp.Cursor != "" {
+		t.Errorf("expected no cursor, got %q", resp.Cursor)
+	}
+	if resp.OldestLedger != 0 || resp.LatestLedger != 0 {
+		t.Errorf("expected zero ledger bounds on an empty table, got oldest=%d latest=%d", resp.OldestLedger, resp.LatestLedger)
+	}
+}
@@ -0,0 +1,155 @@
+package history
+
+import (
+	"context"
+	"time"
+
+	"github.com/stellar/go/support/errors"
+	"github.com/stellar/go/xdr"
+)
+
+type trustLineMutationKind int
+
+const (
+	trustLineMutationUpsert trustLineMutationKind = iota
+	trustLineMutationRemove
+)
+
+type trustLineMutation struct {
+	kind  trustLineMutationKind
+	entry xdr.LedgerEntry
+	key   xdr.LedgerKeyTrustLine
+}
+
+// TrustLineBatchStats reports how many writes a TrustLineMutationBatch
+// coalesced away and how many it actually applied to the database.
+type TrustLineBatchStats struct {
+	Deduped int
+	Applied int
+}
+
+// TrustLineMutationBatch accumulates Upsert/Remove operations against the
+// trust_lines table keyed by ledger_key, coalescing repeated writes to the
+// same key within the batch before Apply executes them in one transaction.
+// Apply issues a fixed number of statements per batch rather than one per
+// key; it is not a single SQL round trip.
+//
+// Writes to the same ledger_key are resolved last-writer-wins by call
+// order: whichever of Upsert/Remove was staged most recently for a key is
+// the one Apply executes, so a Remove followed later by an Upsert for the
+// same key (e.g. a ChangeTrust to limit 0 followed by another re-
+// establishing it within the same ledger) correctly re-creates the row
+// instead of losing it.
+type TrustLineMutationBatch struct {
+	q               *Q
+	ledgerSequence  uint32
+	ledgerCloseTime time.Time
+
+	order     []string
+	mutations map[string]trustLineMutation
+	stats     TrustLineBatchStats
+}
+
+// NewTrustLineBatch returns a TrustLineMutationBatch that will record
+// resulting trust_line_changes rows against ledgerSequence/ledgerCloseTime
+// once applied.
+func (q *Q) NewTrustLineBatch(ledgerSequence uint32, ledgerCloseTime time.Time) *TrustLineMutationBatch {
+	return &TrustLineMutationBatch{
+		q:               q,
+		ledgerSequence:  ledgerSequence,
+		ledgerCloseTime: ledgerCloseTime,
+		mutations:       map[string]trustLineMutation{},
+	}
+}
+
+// Upsert stages entry to be inserted or updated on Apply. If the same
+// ledger_key was already staged earlier in this batch (by either Upsert or
+// Remove), this call wins and replaces it.
+func (b *TrustLineMutationBatch) Upsert(entry xdr.LedgerEntry) error {
+	key, err := trustLineEntryToLedgerKeyString(entry)
+	if err != nil {
+		return errors.Wrap(err, "Error running trustLineEntryToLedgerKeyString")
+	}
+	b.stage(key, trustLineMutation{kind: trustLineMutationUpsert, entry: entry})
+	return nil
+}
+
+// Remove stages key to be deleted on Apply. If the same ledger_key was
+// already staged earlier in this batch (by either Upsert or Remove), this
+// call wins and replaces it.
+func (b *TrustLineMutationBatch) Remove(key xdr.LedgerKeyTrustLine) error {
+	lkey, err := ledgerKeyTrustLineToString(key)
+	if err != nil {
+		return errors.Wrap(err, "Error ledgerKeyTrustLineToString MarshalBinaryCompress")
+	}
+	b.stage(lkey, trustLineMutation{kind: trustLineMutationRemove, key: key})
+	return nil
+}
+
+// stage records a mutation for ledgerKey, applying the last-writer-wins
+// coalescing rule: whichever mutation is staged most recently for a key
+// replaces whatever was staged before it, regardless of kind.
+func (b *TrustLineMutationBatch) stage(ledgerKey string, mutation trustLineMutation) {
+	if _, ok := b.mutations[ledgerKey]; !ok {
+		b.order = append(b.order, ledgerKey)
+		b.mutations[ledgerKey] = mutation
+		return
+	}
+
+	b.stats.Deduped++
+	b.mutations[ledgerKey] = mutation
+}
+
+// Apply executes the coalesced mutations atomically inside a single
+// transaction: one batched DELETE (plus one bulk change-log insert) for all
+// staged removes, and a single UpsertTrustLines call for the remaining
+// upserts. Neither path issues a per-key round trip.
+func (b *TrustLineMutationBatch) Apply(ctx context.Context) error {
+	ownsTransaction := b.q.GetTx() == nil
+	if ownsTransaction {
+		if err := b.q.Begin(ctx); err != nil {
+			return errors.Wrap(err, "could not start transaction")
+		}
+		defer b.q.Rollback()
+	}
+
+	var upserts []xdr.LedgerEntry
+	var removes []xdr.LedgerKeyTrustLine
+	applied := 0
+	for _, key := range b.order {
+		switch mutation := b.mutations[key]; mutation.kind {
+		case trustLineMutationRemove:
+			removes = append(removes, mutation.key)
+			applied++
+		case trustLineMutationUpsert:
+			upserts = append(upserts, mutation.entry)
+			applied++
+		}
+	}
+
+	if len(removes) > 0 {
+		if _, err := b.q.batchRemoveTrustLines(ctx, b.ledgerSequence, b.ledgerCloseTime, removes); err != nil {
+			return err
+		}
+	}
+	if len(upserts) > 0 {
+		if err := b.q.UpsertTrustLines(ctx, b.ledgerSequence, b.ledgerCloseTime, upserts); err != nil {
+			return err
+		}
+	}
+	b.stats.Applied = applied
+
+	if ownsTransaction {
+		if err := b.q.Commit(); err != nil {
+			return errors.Wrap(err, "could not commit transaction")
+		}
+	}
+
+	return nil
+}
+
+// Stats reports the number of writes this batch deduped away and the number
+// it ultimately applied.
+func (b *TrustLineMutationBatch) Stats() TrustLineBatchStats {
+	return b.stats
+}
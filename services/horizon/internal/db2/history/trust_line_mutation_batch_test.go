@@ -0,0 +1,110 @@
+package history
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stellar/go/keypair"
+	"github.com/stellar/go/xdr"
+)
+
+// trustLineEntryAndKey builds a trust line ledger entry for account/issuer
+// and returns it alongside the xdr.LedgerKeyTrustLine identifying it, so
+// Upsert and Remove can be staged against the same ledger_key.
+func trustLineEntryAndKey(t *testing.T, account, issuer string, balance xdr.Int64) (xdr.LedgerEntry, xdr.LedgerKeyTrustLine) {
+	t.Helper()
+
+	var accountID xdr.AccountId
+	if err := accountID.SetAddress(account); err != nil {
+		t.Fatalf("could not set account address: %v", err)
+	}
+	asset := xdr.MustNewCreditAsset("COALESCE", issuer)
+
+	entry := xdr.LedgerEntry{
+		LastModifiedLedgerSeq: 1,
+		Data: xdr.LedgerEntryData{
+			Type: xdr.LedgerEntryTypeTrustline,
+			TrustLine: &xdr.TrustLineEntry{
+				AccountId: accountID,
+				Asset:     asset,
+				Balance:   balance,
+				Limit:     xdr.Int64(1000),
+				Flags:     xdr.Uint32(1),
+			},
+		},
+	}
+
+	key := xdr.LedgerKeyTrustLine{
+		AccountId: accountID,
+		Asset:     asset.ToTrustLineAsset(),
+	}
+
+	return entry, key
+}
+
+// TestTrustLineMutationBatchRemoveThenUpsertWins exercises a trust line
+// removed and then re-established later in the same batch (e.g. a
+// ChangeTrust to limit 0 followed by another ChangeTrust restoring it):
+// the later Upsert must win, not be dropped as it was before stage()
+// stopped treating Remove as an absolute override.
+func TestTrustLineMutationBatchRemoveThenUpsertWins(t *testing.T) {
+	issuer := keypair.MustRandom().Address()
+	account := keypair.MustRandom().Address()
+	entry, key := trustLineEntryAndKey(t, account, issuer, xdr.Int64(500))
+
+	b := (&Q{}).NewTrustLineBatch(1, time.Unix(0, 0).UTC())
+	if err := b.Remove(key); err != nil {
+		t.Fatalf("Remove returned error: %v", err)
+	}
+	if err := b.Upsert(entry); err != nil {
+		t.Fatalf("Upsert returned error: %v", err)
+	}
+
+	lkey, err := trustLineEntryToLedgerKeyString(entry)
+	if err != nil {
+		t.Fatalf("trustLineEntryToLedgerKeyString returned error: %v", err)
+	}
+
+	mutation, ok := b.mutations[lkey]
+	if !ok {
+		t.Fatalf("expected a staged mutation for %q", lkey)
+	}
+	if mutation.kind != trustLineMutationUpsert {
+		t.Errorf("expected the later Upsert to win, got kind %v", mutation.kind)
+	}
+	if b.stats.Deduped != 1 {
+		t.Errorf("expected one deduped write, got %d", b.stats.Deduped)
+	}
+	if len(b.order) != 1 {
+		t.Errorf("expected a single order entry for the coalesced key, got %d", len(b.order))
+	}
+}
+
+// TestTrustLineMutationBatchUpsertThenRemoveWins is the mirror case: a
+// Remove staged after an Upsert for the same key must win.
+func TestTrustLineMutationBatchUpsertThenRemoveWins(t *testing.T) {
+	issuer := keypair.MustRandom().Address()
+	account := keypair.MustRandom().Address()
+	entry, key := trustLineEntryAndKey(t, account, issuer, xdr.Int64(500))
+
+	b := (&Q{}).NewTrustLineBatch(1, time.Unix(0, 0).UTC())
+	if err := b.Upsert(entry); err != nil {
+		t.Fatalf("Upsert returned error: %v", err)
+	}
+	if err := b.Remove(key); err != nil {
+		t.Fatalf("Remove returned error: %v", err)
+	}
+
+	lkey, err := trustLineEntryToLedgerKeyString(entry)
+	if err != nil {
+		t.Fatalf("trustLineEntryToLedgerKeyString returned error: %v", err)
+	}
+
+	mutation, ok := b.mutations[lkey]
+	if !ok {
+		t.Fatalf("expected a staged mutation for %q", lkey)
+	}
+	if mutation.kind != trustLineMutationRemove {
+		t.Errorf("expected the later Remove to win, got kind %v", mutation.kind)
+	}
+}
@@ -4,10 +4,10 @@ import (
 	"context"
 	"database/sql"
 	"encoding/base64"
+	"time"
 
 	sq "github.com/Masterminds/squirrel"
 	"github.com/guregu/null"
-	"github.com/lib/pq"
 	"github.com/stellar/go/support/errors"
 	"github.com/stellar/go/xdr"
 )
@@ -140,111 +140,52 @@ func (q *Q) UpdateTrustLine(ctx context.Context, entry xdr.LedgerEntry) (int64,
 	return result.RowsAffected()
 }
 
-// UpsertTrustLines upserts a batch of trust lines in the trust lines table.
-// There's currently no limit of the number of trust lines this method can
-// accept other than 2GB limit of the query string length what should be enough
-// for each ledger with the current limits.
-func (q *Q) UpsertTrustLines(ctx context.Context, trustLines []xdr.LedgerEntry) error {
-	var ledgerKey, accountID, assetIssuer, assetCode []string
-	var balance, limit, buyingLiabilities, sellingLiabilities []xdr.Int64
-	var flags, lastModifiedLedger []xdr.Uint32
-	var assetType []xdr.AssetType
-	var sponsor []null.String
+// UpsertTrustLines upserts a batch of trust lines in the trust lines table
+// by driving a single-flush TrustLinesBatchInserter, which also records a
+// trust_line_changes row for every entry in one bulk insert, capturing the
+// balance/limit/flags/liabilities values the upsert replaced.
+//
+// Callers can instead construct their own TrustLinesBatchInserter with
+// NewTrustLinesBatchInserter to choose a different batchSize. An inserter
+// stamps every trust_line_changes row it writes with the single
+// ledgerSequence and ledgerCloseTime it was constructed with, so, like
+// UpsertTrustLines, one inserter covers the entries of one ledger.
+func (q *Q) UpsertTrustLines(ctx context.Context, ledgerSequence uint32, ledgerCloseTime time.Time, trustLines []xdr.LedgerEntry) error {
+	if len(trustLines) == 0 {
+		return nil
+	}
 
+	inserter, err := NewTrustLinesBatchInserter(ctx, q.Session, ledgerSequence, ledgerCloseTime, len(trustLines))
+	if err != nil {
+		return err
+	}
 	for _, entry := range trustLines {
-		if entry.Data.Type != xdr.LedgerEntryTypeTrustline {
-			return errors.Errorf("Invalid entry type: %d", entry.Data.Type)
+		if err := inserter.Add(ctx, entry); err != nil {
+			return err
 		}
-
-		key, err := trustLineEntryToLedgerKeyString(entry)
-		if err != nil {
-			return errors.Wrap(err, "Error running trustLineEntryToLedgerKeyString")
-		}
-
-		m := trustLineToMap(entry)
-		ledgerKey = append(ledgerKey, key)
-		accountID = append(accountID, m["account_id"].(string))
-		assetType = append(assetType, m["asset_type"].(xdr.AssetType))
-		assetIssuer = append(assetIssuer, m["asset_issuer"].(string))
-		assetCode = append(assetCode, m["asset_code"].(string))
-		balance = append(balance, m["balance"].(xdr.Int64))
-		limit = append(limit, m["trust_line_limit"].(xdr.Int64))
-		buyingLiabilities = append(buyingLiabilities, m["buying_liabilities"].(xdr.Int64))
-		sellingLiabilities = append(sellingLiabilities, m["selling_liabilities"].(xdr.Int64))
-		flags = append(flags, m["flags"].(xdr.Uint32))
-		lastModifiedLedger = append(lastModifiedLedger, m["last_modified_ledger"].(xdr.Uint32))
-		sponsor = append(sponsor, m["sponsor"].(null.String))
 	}
-
-	sql := `
-	WITH r AS
-		(SELECT
-			unnest(?::text[]),
-			unnest(?::text[]),
-			unnest(?::int[]),
-			unnest(?::text[]),
-			unnest(?::text[]),
-			unnest(?::bigint[]),
-			unnest(?::bigint[]),
-			unnest(?::bigint[]),
-			unnest(?::bigint[]),
-			unnest(?::int[]),
-			unnest(?::int[]),
-			unnest(?::text[])
-		)
-	INSERT INTO trust_lines ( 
-		ledger_key,
-		account_id,
-		asset_type,
-		asset_issuer,
-		asset_code,
-		balance,
-		trust_line_limit,
-		buying_liabilities,
-		selling_liabilities,
-		flags,
-		last_modified_ledger,
-		sponsor
-	)
-	SELECT * from r 
-	ON CONFLICT (ledger_key) DO UPDATE SET 
-		ledger_key = excluded.ledger_key,
-		account_id = excluded.account_id,
-		asset_type = excluded.asset_type,
-		asset_issuer = excluded.asset_issuer,
-		asset_code = excluded.asset_code,
-		balance = excluded.balance,
-		trust_line_limit = excluded.trust_line_limit,
-		buying_liabilities = excluded.buying_liabilities,
-		selling_liabilities = excluded.selling_liabilities,
-		flags = excluded.flags,
-		last_modified_ledger = excluded.last_modified_ledger,
-		sponsor = excluded.sponsor`
-
-	_, err := q.ExecRaw(ctx, sql,
-		pq.Array(ledgerKey),
-		pq.Array(accountID),
-		pq.Array(assetType),
-		pq.Array(assetIssuer),
-		pq.Array(assetCode),
-		pq.Array(balance),
-		pq.Array(limit),
-		pq.Array(buyingLiabilities),
-		pq.Array(sellingLiabilities),
-		pq.Array(flags),
-		pq.Array(lastModifiedLedger),
-		pq.Array(sponsor))
-	return err
+	return inserter.Exec(ctx)
 }
 
-// RemoveTrustLine deletes a row in the trust lines table.
+// RemoveTrustLine deletes a row in the trust lines table and records its
+// removal in trust_line_changes. Must be called inside a transaction so the
+// delete and the change-log insert commit or roll back together.
 // Returns number of rows affected and error.
-func (q *Q) RemoveTrustLine(ctx context.Context, ledgerKey xdr.LedgerKeyTrustLine) (int64, error) {
+func (q *Q) RemoveTrustLine(ctx context.Context, ledgerSequence uint32, ledgerCloseTime time.Time, ledgerKey xdr.LedgerKeyTrustLine) (int64, error) {
+	if q.GetTx() == nil {
+		return 0, errors.New("cannot be called outside of a transaction")
+	}
+
 	key, err := ledgerKeyTrustLineToString(ledgerKey)
 	if err != nil {
 		return 0, errors.Wrap(err, "Error ledgerKeyTrustLineToString MarshalBinaryCompress")
 	}
 
+	previous, err := q.trustLineSnapshotsByKey(ctx, []string{key})
+	if err != nil {
+		return 0, err
+	}
+
 	sql := sq.Delete("trust_lines").
 		Where(map[string]interface{}{"ledger_key": key})
 	result, err := q.Exec(ctx, sql)
@@ -252,6 +193,23 @@ func (q *Q) RemoveTrustLine(ctx context.Context, ledgerKey xdr.LedgerKeyTrustLin
 		return 0, err
 	}
 
+	change := TrustLineChange{
+		LedgerSequence: ledgerSequence,
+		LedgerClosedAt: ledgerCloseTime,
+		LedgerKey:      key,
+		ChangeType:     TrustLineChangeTypeRemove,
+	}
+	if prev, ok := previous[key]; ok {
+		change.PreviousBalance = null.IntFrom(int64(prev.Balance))
+		change.PreviousTrustLineLimit = null.IntFrom(int64(prev.TrustLineLimit))
+		change.PreviousFlags = null.IntFrom(int64(prev.Flags))
+		change.PreviousBuyingLiabilities = null.IntFrom(int64(prev.BuyingLiabilities))
+		change.PreviousSellingLiabilities = null.IntFrom(int64(prev.SellingLiabilities))
+	}
+	if err := q.insertTrustLineChange(ctx, change); err != nil {
+		return 0, errors.Wrap(err, "could not insert trust line change")
+	}
+
 	return result.RowsAffected()
 }
 
@@ -0,0 +1,270 @@
+package history
+
+import (
+	"context"
+	"time"
+
+	"github.com/guregu/null"
+	"github.com/lib/pq"
+	"github.com/stellar/go/support/db"
+	"github.com/stellar/go/support/errors"
+	"github.com/stellar/go/xdr"
+)
+
+// trustLinesTmpTable is the unlogged staging table COPY'd into before the
+// final merge into trust_lines. It is created the first time a
+// TrustLinesBatchInserter is constructed within a transaction, and
+// truncated every time one is constructed.
+const trustLinesTmpTable = "trust_lines_tmp"
+
+// TrustLinesBatchInserter is a streaming, COPY-based replacement for the
+// unnest-array INSERT that UpsertTrustLines used before; UpsertTrustLines
+// now delegates to it. It is meant for full reingestion, where the unnest
+// approach becomes memory- and CPU-heavy because it has to marshal every
+// column into a single query string.
+//
+// Entries are streamed into an unlogged staging table via pq.CopyIn in
+// batches of batchSize, and Exec merges the staging table into trust_lines
+// with a single INSERT ... SELECT ... ON CONFLICT statement. Exec also
+// records one trust_line_changes row per entry in a single bulk insert,
+// every row stamped with the ledger the inserter was constructed for, so
+// driving a TrustLinesBatchInserter directly records the same change log
+// as UpsertTrustLines as long as each inserter holds one ledger's entries.
+type TrustLinesBatchInserter struct {
+	session         *db.Session
+	batchSize       int
+	ledgerSequence  uint32
+	ledgerCloseTime time.Time
+
+	pending  []xdr.LedgerEntry
+	inserted int
+
+	keys    []string
+	entries []xdr.LedgerEntry
+}
+
+// NewTrustLinesBatchInserter returns a TrustLinesBatchInserter that streams
+// into the trust_lines table through an unlogged staging table. The caller
+// is expected to already be inside a transaction on session (see
+// db.Session.Begin), since the staging table is created and truncated for
+// the lifetime of that transaction. ledgerSequence and ledgerCloseTime are
+// stamped onto every trust_line_changes row Exec writes, so callers should
+// construct a new TrustLinesBatchInserter per ledger even if they reuse a
+// larger batchSize across many Add calls.
+func NewTrustLinesBatchInserter(ctx context.Context, session *db.Session, ledgerSequence uint32, ledgerCloseTime time.Time, batchSize int) (*TrustLinesBatchInserter, error) {
+	if tx := session.GetTx(); tx == nil {
+		return nil, errors.New("cannot create TrustLinesBatchInserter outside of a transaction")
+	}
+
+	_, err := session.ExecRaw(ctx, `
+		CREATE TEMPORARY TABLE IF NOT EXISTS `+trustLinesTmpTable+`
+		(LIKE trust_lines INCLUDING DEFAULTS)
+		ON COMMIT DROP
+	`)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create trust lines staging table")
+	}
+	if _, err := session.ExecRaw(ctx, "TRUNCATE "+trustLinesTmpTable); err != nil {
+		return nil, errors.Wrap(err, "could not truncate trust lines staging table")
+	}
+
+	return &TrustLinesBatchInserter{
+		session:         session,
+		batchSize:       batchSize,
+		ledgerSequence:  ledgerSequence,
+		ledgerCloseTime: ledgerCloseTime,
+	}, nil
+}
+
+// Add stages a trust line entry to be written on the next Exec call,
+// flushing the current batch into the staging table once batchSize entries
+// have accumulated. ctx governs the flush, so callers can cancel a
+// multi-hundred-thousand-row COPY mid-batch.
+func (i *TrustLinesBatchInserter) Add(ctx context.Context, entry xdr.LedgerEntry) error {
+	if entry.Data.Type != xdr.LedgerEntryTypeTrustline {
+		return errors.Errorf("Invalid entry type: %d", entry.Data.Type)
+	}
+
+	key, err := trustLineEntryToLedgerKeyString(entry)
+	if err != nil {
+		return errors.Wrap(err, "Error running trustLineEntryToLedgerKeyString")
+	}
+
+	i.pending = append(i.pending, entry)
+	i.entries = append(i.entries, entry)
+	i.keys = append(i.keys, key)
+	if len(i.pending) >= i.batchSize {
+		return i.flush(ctx)
+	}
+	return nil
+}
+
+// Len returns the number of entries added via Add across the lifetime of
+// this inserter, including ones already flushed to the staging table.
+func (i *TrustLinesBatchInserter) Len() int {
+	return i.inserted + len(i.pending)
+}
+
+// flush streams any pending entries into the staging table using
+// pq.CopyIn, without touching trust_lines itself.
+func (i *TrustLinesBatchInserter) flush(ctx context.Context) error {
+	if len(i.pending) == 0 {
+		return nil
+	}
+
+	stmt, err := i.session.GetTx().Preparex(pq.CopyIn(
+		trustLinesTmpTable,
+		"ledger_key",
+		"account_id",
+		"asset_type",
+		"asset_issuer",
+		"asset_code",
+		"balance",
+		"trust_line_limit",
+		"buying_liabilities",
+		"selling_liabilities",
+		"flags",
+		"last_modified_ledger",
+		"sponsor",
+	))
+	if err != nil {
+		return errors.Wrap(err, "could not prepare trust lines COPY statement")
+	}
+
+	for _, entry := range i.pending {
+		key, err := trustLineEntryToLedgerKeyString(entry)
+		if err != nil {
+			stmt.Close()
+			return errors.Wrap(err, "Error running trustLineEntryToLedgerKeyString")
+		}
+		m := trustLineToMap(entry)
+		if _, err := stmt.ExecContext(ctx,
+			key,
+			m["account_id"],
+			m["asset_type"],
+			m["asset_issuer"],
+			m["asset_code"],
+			m["balance"],
+			m["trust_line_limit"],
+			m["buying_liabilities"],
+			m["selling_liabilities"],
+			m["flags"],
+			m["last_modified_ledger"],
+			m["sponsor"],
+		); err != nil {
+			stmt.Close()
+			return errors.Wrap(err, "could not copy trust line row")
+		}
+	}
+
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		stmt.Close()
+		return errors.Wrap(err, "could not flush trust lines COPY statement")
+	}
+	if err := stmt.Close(); err != nil {
+		return errors.Wrap(err, "could not close trust lines COPY statement")
+	}
+
+	i.inserted += len(i.pending)
+	i.pending = i.pending[:0]
+	return nil
+}
+
+// Exec flushes any remaining pending entries, merges the staging table into
+// trust_lines with a single INSERT ... SELECT ... ON CONFLICT DO UPDATE
+// (in place of the per-call unnest INSERT UpsertTrustLines used before),
+// and bulk-inserts the resulting trust_line_changes rows in one more round
+// trip. The previous-value snapshot used for those rows is taken just
+// before the merge runs, so it reflects what trust_lines held prior to this
+// Exec regardless of how many Add/flush calls preceded it.
+func (i *TrustLinesBatchInserter) Exec(ctx context.Context) error {
+	if err := i.flush(ctx); err != nil {
+		return err
+	}
+	if i.inserted == 0 {
+		return nil
+	}
+
+	previous, err := trustLineSnapshotsByKey(ctx, i.session, i.keys)
+	if err != nil {
+		return err
+	}
+
+	_, err = i.session.ExecRaw(ctx, `
+		INSERT INTO trust_lines (
+			ledger_key,
+			account_id,
+			asset_type,
+			asset_issuer,
+			asset_code,
+			balance,
+			trust_line_limit,
+			buying_liabilities,
+			selling_liabilities,
+			flags,
+			last_modified_ledger,
+			sponsor
+		)
+		SELECT
+			ledger_key,
+			account_id,
+			asset_type,
+			asset_issuer,
+			asset_code,
+			balance,
+			trust_line_limit,
+			buying_liabilities,
+			selling_liabilities,
+			flags,
+			last_modified_ledger,
+			sponsor
+		FROM `+trustLinesTmpTable+`
+		ON CONFLICT (ledger_key) DO UPDATE SET
+			account_id = excluded.account_id,
+			asset_type = excluded.asset_type,
+			asset_issuer = excluded.asset_issuer,
+			asset_code = excluded.asset_code,
+			balance = excluded.balance,
+			trust_line_limit = excluded.trust_line_limit,
+			buying_liabilities = excluded.buying_liabilities,
+			selling_liabilities = excluded.selling_liabilities,
+			flags = excluded.flags,
+			last_modified_ledger = excluded.last_modified_ledger,
+			sponsor = excluded.sponsor
+	`)
+	if err != nil {
+		return errors.Wrap(err, "could not merge trust lines staging table")
+	}
+
+	changes := make([]TrustLineChange, len(i.entries))
+	for idx, entry := range i.entries {
+		key := i.keys[idx]
+		m := trustLineToMap(entry)
+		change := TrustLineChange{
+			LedgerSequence:        i.ledgerSequence,
+			LedgerClosedAt:        i.ledgerCloseTime,
+			LedgerKey:             key,
+			NewBalance:            null.IntFrom(int64(m["balance"].(xdr.Int64))),
+			NewTrustLineLimit:     null.IntFrom(int64(m["trust_line_limit"].(xdr.Int64))),
+			NewFlags:              null.IntFrom(int64(m["flags"].(xdr.Uint32))),
+			NewBuyingLiabilities:  null.IntFrom(int64(m["buying_liabilities"].(xdr.Int64))),
+			NewSellingLiabilities: null.IntFrom(int64(m["selling_liabilities"].(xdr.Int64))),
+		}
+		if prev, ok := previous[key]; ok {
+			change.ChangeType = TrustLineChangeTypeUpdate
+			change.PreviousBalance = null.IntFrom(int64(prev.Balance))
+			change.PreviousTrustLineLimit = null.IntFrom(int64(prev.TrustLineLimit))
+			change.PreviousFlags = null.IntFrom(int64(prev.Flags))
+			change.PreviousBuyingLiabilities = null.IntFrom(int64(prev.BuyingLiabilities))
+			change.PreviousSellingLiabilities = null.IntFrom(int64(prev.SellingLiabilities))
+		} else {
+			change.ChangeType = TrustLineChangeTypeCreate
+		}
+		changes[idx] = change
+	}
+	if err := bulkInsertTrustLineChanges(ctx, i.session, changes); err != nil {
+		return errors.Wrap(err, "could not bulk insert trust line changes")
+	}
+
+	return nil
+}
@@ -0,0 +1,191 @@
+package history
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/guregu/null"
+	"github.com/lib/pq"
+	"github.com/stellar/go/keypair"
+	"github.com/stellar/go/support/db/dbtest"
+	"github.com/stellar/go/xdr"
+)
+
+// benchmarkTrustLineEntries builds n synthetic trust line ledger entries,
+// one per distinct account, for use as COPY/unnest benchmark input.
+func benchmarkTrustLineEntries(n int) []xdr.LedgerEntry {
+	issuer := keypair.MustRandom().Address()
+	entries := make([]xdr.LedgerEntry, n)
+	for i := 0; i < n; i++ {
+		account := keypair.MustRandom().Address()
+		var accountID xdr.AccountId
+		if err := accountID.SetAddress(account); err != nil {
+			panic(err)
+		}
+		asset := xdr.MustNewCreditAsset("BENCH", issuer)
+
+		entries[i] = xdr.LedgerEntry{
+			LastModifiedLedgerSeq: 1,
+			Data: xdr.LedgerEntryData{
+				Type: xdr.LedgerEntryTypeTrustline,
+				TrustLine: &xdr.TrustLineEntry{
+					AccountId: accountID,
+					Asset:     asset,
+					Balance:   xdr.Int64(i),
+					Limit:     xdr.Int64(1000000000),
+					Flags:     xdr.Uint32(1),
+				},
+			},
+		}
+	}
+	return entries
+}
+
+// upsertTrustLinesUnnestLegacy is the pre-chunk0-2 unnest-array INSERT, kept
+// here only so BenchmarkTrustLinesUpsert has something to compare the COPY
+// path against; it is not used by any production code path anymore.
+func upsertTrustLinesUnnestLegacy(ctx context.Context, q *Q, trustLines []xdr.LedgerEntry) error {
+	var ledgerKey, accountID, assetIssuer, assetCode []string
+	var balance, limit, buyingLiabilities, sellingLiabilities []xdr.Int64
+	var flags, lastModifiedLedger []xdr.Uint32
+	var assetType []xdr.AssetType
+	var sponsor []null.String
+
+	for _, entry := range trustLines {
+		key, err := trustLineEntryToLedgerKeyString(entry)
+		if err != nil {
+			return err
+		}
+		m := trustLineToMap(entry)
+		ledgerKey = append(ledgerKey, key)
+		accountID = append(accountID, m["account_id"].(string))
+		assetType = append(assetType, m["asset_type"].(xdr.AssetType))
+		assetIssuer = append(assetIssuer, m["asset_issuer"].(string))
+		assetCode = append(assetCode, m["asset_code"].(string))
+		balance = append(balance, m["balance"].(xdr.Int64))
+		limit = append(limit, m["trust_line_limit"].(xdr.Int64))
+		buyingLiabilities = append(buyingLiabilities, m["buying_liabilities"].(xdr.Int64))
+		sellingLiabilities = append(sellingLiabilities, m["selling_liabilities"].(xdr.Int64))
+		flags = append(flags, m["flags"].(xdr.Uint32))
+		lastModifiedLedger = append(lastModifiedLedger, m["last_modified_ledger"].(xdr.Uint32))
+		sponsor = append(sponsor, m["sponsor"].(null.String))
+	}
+
+	sql := `
+	WITH r AS
+		(SELECT
+			unnest(?::text[]),
+			unnest(?::text[]),
+			unnest(?::int[]),
+			unnest(?::text[]),
+			unnest(?::text[]),
+			unnest(?::bigint[]),
+			unnest(?::bigint[]),
+			unnest(?::bigint[]),
+			unnest(?::bigint[]),
+			unnest(?::int[]),
+			unnest(?::int[]),
+			unnest(?::text[])
+		)
+	INSERT INTO trust_lines (
+		ledger_key,
+		account_id,
+		asset_type,
+		asset_issuer,
+		asset_code,
+		balance,
+		trust_line_limit,
+		buying_liabilities,
+		selling_liabilities,
+		flags,
+		last_modified_ledger,
+		sponsor
+	)
+	SELECT * from r
+	ON CONFLICT (ledger_key) DO UPDATE SET
+		ledger_key = excluded.ledger_key,
+		account_id = excluded.account_id,
+		asset_type = excluded.asset_type,
+		asset_issuer = excluded.asset_issuer,
+		asset_code = excluded.asset_code,
+		balance = excluded.balance,
+		trust_line_limit = excluded.trust_line_limit,
+		buying_liabilities = excluded.buying_liabilities,
+		selling_liabilities = excluded.selling_liabilities,
+		flags = excluded.flags,
+		last_modified_ledger = excluded.last_modified_ledger,
+		sponsor = excluded.sponsor`
+
+	_, err := q.ExecRaw(ctx, sql,
+		pq.Array(ledgerKey),
+		pq.Array(accountID),
+		pq.Array(assetType),
+		pq.Array(assetIssuer),
+		pq.Array(assetCode),
+		pq.Array(balance),
+		pq.Array(limit),
+		pq.Array(buyingLiabilities),
+		pq.Array(sellingLiabilities),
+		pq.Array(flags),
+		pq.Array(lastModifiedLedger),
+		pq.Array(sponsor))
+	return err
+}
+
+// BenchmarkTrustLinesUpsert compares the legacy unnest-array INSERT against
+// the COPY-based TrustLinesBatchInserter across batch sizes representative
+// of full reingestion (10k-500k entries per run; the COPY inserter flushes
+// every 50k entries).
+func BenchmarkTrustLinesUpsert(b *testing.B) {
+	db := dbtest.Postgres(b)
+	defer db.Close()
+
+	session := db.Open()
+	defer session.Close()
+	q := &Q{session}
+
+	for _, size := range []int{10_000, 100_000, 500_000} {
+		entries := benchmarkTrustLineEntries(size)
+
+		b.Run(fmt.Sprintf("unnest/%d", size), func(b *testing.B) {
+			ctx := context.Background()
+			for i := 0; i < b.N; i++ {
+				if err := q.Begin(ctx); err != nil {
+					b.Fatal(err)
+				}
+				if err := upsertTrustLinesUnnestLegacy(ctx, q, entries); err != nil {
+					b.Fatal(err)
+				}
+				if err := q.Rollback(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+
+		b.Run(fmt.Sprintf("copy/%d", size), func(b *testing.B) {
+			ctx := context.Background()
+			for i := 0; i < b.N; i++ {
+				if err := q.Begin(ctx); err != nil {
+					b.Fatal(err)
+				}
+				inserter, err := NewTrustLinesBatchInserter(ctx, q.Session, 1, time.Unix(0, 0).UTC(), 50_000)
+				if err != nil {
+					b.Fatal(err)
+				}
+				for _, entry := range entries {
+					if err := inserter.Add(ctx, entry); err != nil {
+						b.Fatal(err)
+					}
+				}
+				if err := inserter.Exec(ctx); err != nil {
+					b.Fatal(err)
+				}
+				if err := q.Rollback(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}